@@ -0,0 +1,157 @@
+package gcp
+
+import (
+	"context"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+	lru "github.com/hashicorp/golang-lru"
+
+	"github.com/cortexproject/cortex/pkg/chunk"
+)
+
+// defaultQueryCacheTTL is how long a cached QueryPages result stays valid
+// when Config.QueryCacheTTL is unset.
+const defaultQueryCacheTTL = 15 * time.Minute
+
+// wrapQueryCache wraps client in a cachingIndexClient when cfg.QueryCacheSize
+// is set, otherwise it returns client unchanged.
+func wrapQueryCache(cfg Config, schemaCfg chunk.SchemaConfig, client chunk.IndexClient) (chunk.IndexClient, error) {
+	if cfg.QueryCacheSize <= 0 {
+		return client, nil
+	}
+
+	ttl := cfg.QueryCacheTTL
+	if ttl <= 0 {
+		ttl = defaultQueryCacheTTL
+	}
+
+	cache, err := lru.New(cfg.QueryCacheSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cachingIndexClient{
+		IndexClient: client,
+		schemaCfg:   schemaCfg,
+		cache:       cache,
+		ttl:         ttl,
+	}, nil
+}
+
+// cachingIndexClient wraps a chunk.IndexClient with an in-memory LRU cache of
+// QueryPages results, keyed on the query itself. Periodic tables belonging to
+// the current schema period keep receiving writes, so queries against them
+// are served live and never cached.
+type cachingIndexClient struct {
+	chunk.IndexClient
+	schemaCfg chunk.SchemaConfig
+	cache     *lru.Cache
+	ttl       time.Duration
+}
+
+type queryCacheKey struct {
+	tableName        string
+	hashValue        string
+	rangeValuePrefix string
+	rangeValueStart  string
+	valueEqual       string
+}
+
+func queryCacheKeyFor(query chunk.IndexQuery) queryCacheKey {
+	return queryCacheKey{
+		tableName:        query.TableName,
+		hashValue:        query.HashValue,
+		rangeValuePrefix: string(query.RangeValuePrefix),
+		rangeValueStart:  string(query.RangeValueStart),
+		valueEqual:       string(query.ValueEqual),
+	}
+}
+
+type queryCacheEntry struct {
+	expires time.Time
+	pairs   []rangeValuePair
+}
+
+type rangeValuePair struct {
+	rangeValue []byte
+	value      []byte
+}
+
+func (c *cachingIndexClient) QueryPages(ctx context.Context, queries []chunk.IndexQuery, callback func(chunk.IndexQuery, chunk.ReadBatch) bool) error {
+	live := make([]chunk.IndexQuery, 0, len(queries))
+	for _, query := range queries {
+		if !c.cacheable(query.TableName) {
+			live = append(live, query)
+			continue
+		}
+
+		key := queryCacheKeyFor(query)
+		cached, ok := c.cache.Get(key)
+		if !ok {
+			live = append(live, query)
+			continue
+		}
+
+		entry := cached.(queryCacheEntry)
+		if time.Now().After(entry.expires) {
+			c.cache.Remove(key)
+			live = append(live, query)
+			continue
+		}
+
+		// A false here only means this particular query is done, same as the
+		// uncached ReadRows callback below; it must not abandon the other
+		// queries batched into this call.
+		callback(query, &columnKeyBatch{items: toReadItems(entry.pairs)})
+	}
+
+	if len(live) == 0 {
+		return nil
+	}
+
+	// storageClientV1 invokes its callback once per matching row, not once
+	// per query (see rowBatch's doc comment), so a single query can drive
+	// several callback invocations here. Buffer those into pending and only
+	// write the cache once the live call returns, instead of overwriting the
+	// cache entry on every invocation and ending up with just the last row.
+	pending := map[queryCacheKey][]rangeValuePair{}
+	err := c.IndexClient.QueryPages(ctx, live, func(query chunk.IndexQuery, batch chunk.ReadBatch) bool {
+		if c.cacheable(query.TableName) {
+			key := queryCacheKeyFor(query)
+			pending[key] = append(pending[key], collectPairs(batch)...)
+		}
+		return callback(query, batch)
+	})
+
+	for key, pairs := range pending {
+		c.cache.Add(key, queryCacheEntry{
+			expires: time.Now().Add(c.ttl),
+			pairs:   pairs,
+		})
+	}
+
+	return err
+}
+
+// cacheable reports whether tableName is safe to cache, i.e. it isn't the
+// table the current schema period is actively writing to.
+func (c *cachingIndexClient) cacheable(tableName string) bool {
+	return tableName != c.schemaCfg.TableFor(time.Now())
+}
+
+func collectPairs(batch chunk.ReadBatch) []rangeValuePair {
+	var pairs []rangeValuePair
+	for iter := batch.Iterator(); iter.Next(); {
+		pairs = append(pairs, rangeValuePair{rangeValue: iter.RangeValue(), value: iter.Value()})
+	}
+	return pairs
+}
+
+func toReadItems(pairs []rangeValuePair) []bigtable.ReadItem {
+	items := make([]bigtable.ReadItem, len(pairs))
+	for i, p := range pairs {
+		items[i] = bigtable.ReadItem{Column: columnPrefix + string(p.rangeValue), Value: p.value}
+	}
+	return items
+}
@@ -0,0 +1,219 @@
+package gcp
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+
+	"github.com/cortexproject/cortex/pkg/chunk"
+)
+
+type fakeReadBatch struct {
+	pairs []rangeValuePair
+}
+
+func (b *fakeReadBatch) Iterator() chunk.ReadBatchIterator {
+	return &fakeReadBatchIterator{i: -1, batch: b}
+}
+
+type fakeReadBatchIterator struct {
+	i     int
+	batch *fakeReadBatch
+}
+
+func (it *fakeReadBatchIterator) Next() bool {
+	it.i++
+	return it.i < len(it.batch.pairs)
+}
+
+func (it *fakeReadBatchIterator) RangeValue() []byte { return it.batch.pairs[it.i].rangeValue }
+func (it *fakeReadBatchIterator) Value() []byte      { return it.batch.pairs[it.i].value }
+
+// fakeIndexClient is a minimal chunk.IndexClient whose QueryPages just
+// records which queries it was asked to serve live and replies with a fixed
+// set of pairs for each. When oneCallbackPerPair is set it invokes the
+// callback once per pair instead of once with the whole batch, mimicking
+// storageClientV1's one-callback-per-row behavior.
+type fakeIndexClient struct {
+	liveQueries        []chunk.IndexQuery
+	pairs              []rangeValuePair
+	oneCallbackPerPair bool
+}
+
+func (f *fakeIndexClient) Stop() {}
+func (f *fakeIndexClient) NewWriteBatch() chunk.WriteBatch {
+	return nil
+}
+func (f *fakeIndexClient) BatchWrite(ctx context.Context, batch chunk.WriteBatch) error {
+	return nil
+}
+func (f *fakeIndexClient) QueryPages(ctx context.Context, queries []chunk.IndexQuery, callback func(chunk.IndexQuery, chunk.ReadBatch) bool) error {
+	f.liveQueries = append(f.liveQueries, queries...)
+	for _, query := range queries {
+		if f.oneCallbackPerPair {
+			for _, pair := range f.pairs {
+				callback(query, &fakeReadBatch{pairs: []rangeValuePair{pair}})
+			}
+			continue
+		}
+		callback(query, &fakeReadBatch{pairs: f.pairs})
+	}
+	return nil
+}
+
+func newTestCachingIndexClient(t *testing.T, inner *fakeIndexClient, ttl time.Duration) *cachingIndexClient {
+	t.Helper()
+	cache, err := lru.New(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &cachingIndexClient{
+		IndexClient: inner,
+		schemaCfg:   chunk.SchemaConfig{},
+		cache:       cache,
+		ttl:         ttl,
+	}
+}
+
+func TestCachingIndexClient_ServesRepeatQueryFromCache(t *testing.T) {
+	inner := &fakeIndexClient{pairs: []rangeValuePair{{rangeValue: []byte("a"), value: []byte("1")}}}
+	c := newTestCachingIndexClient(t, inner, time.Minute)
+
+	query := chunk.IndexQuery{TableName: "not-the-current-table", HashValue: "h"}
+
+	for i := 0; i < 2; i++ {
+		var got []rangeValuePair
+		err := c.QueryPages(context.Background(), []chunk.IndexQuery{query}, func(q chunk.IndexQuery, batch chunk.ReadBatch) bool {
+			got = append(got, collectPairs(batch)...)
+			return true
+		})
+		if err != nil {
+			t.Fatalf("QueryPages: %v", err)
+		}
+		if len(got) != 1 || string(got[0].value) != "1" {
+			t.Fatalf("call %d: got %v, want one pair with value 1", i, got)
+		}
+	}
+
+	if len(inner.liveQueries) != 1 {
+		t.Fatalf("expected the second call to be served from cache, but the wrapped client saw %d live queries", len(inner.liveQueries))
+	}
+}
+
+func TestCachingIndexClient_ExpiredEntryIsRefetchedLive(t *testing.T) {
+	inner := &fakeIndexClient{pairs: []rangeValuePair{{rangeValue: []byte("a"), value: []byte("1")}}}
+	c := newTestCachingIndexClient(t, inner, time.Minute)
+
+	query := chunk.IndexQuery{TableName: "not-the-current-table", HashValue: "h"}
+	key := queryCacheKeyFor(query)
+	c.cache.Add(key, queryCacheEntry{
+		expires: time.Now().Add(-time.Second),
+		pairs:   []rangeValuePair{{rangeValue: []byte("stale"), value: []byte("stale")}},
+	})
+
+	err := c.QueryPages(context.Background(), []chunk.IndexQuery{query}, func(chunk.IndexQuery, chunk.ReadBatch) bool { return true })
+	if err != nil {
+		t.Fatalf("QueryPages: %v", err)
+	}
+
+	if len(inner.liveQueries) != 1 {
+		t.Fatalf("expected the expired entry to be re-fetched live, but the wrapped client saw %d live queries", len(inner.liveQueries))
+	}
+}
+
+func TestCachingIndexClient_CurrentPeriodIsNeverCached(t *testing.T) {
+	inner := &fakeIndexClient{}
+	c := newTestCachingIndexClient(t, inner, time.Minute)
+
+	current := c.schemaCfg.TableFor(time.Now())
+	query := chunk.IndexQuery{TableName: current, HashValue: "h"}
+
+	for i := 0; i < 2; i++ {
+		if err := c.QueryPages(context.Background(), []chunk.IndexQuery{query}, func(chunk.IndexQuery, chunk.ReadBatch) bool { return true }); err != nil {
+			t.Fatalf("QueryPages: %v", err)
+		}
+	}
+
+	if len(inner.liveQueries) != 2 {
+		t.Fatalf("expected every call against the current period's table to be served live, but the wrapped client saw %d live queries", len(inner.liveQueries))
+	}
+}
+
+// TestCachingIndexClient_AccumulatesPairsAcrossCallbackInvocations guards
+// against the bug where a query whose live call drove multiple callback
+// invocations (as storageClientV1 does, one per matching row) ended up
+// caching only the pairs from the last invocation instead of all of them.
+func TestCachingIndexClient_AccumulatesPairsAcrossCallbackInvocations(t *testing.T) {
+	inner := &fakeIndexClient{
+		pairs: []rangeValuePair{
+			{rangeValue: []byte("a"), value: []byte("1")},
+			{rangeValue: []byte("b"), value: []byte("2")},
+			{rangeValue: []byte("c"), value: []byte("3")},
+		},
+		oneCallbackPerPair: true,
+	}
+	c := newTestCachingIndexClient(t, inner, time.Minute)
+
+	query := chunk.IndexQuery{TableName: "not-the-current-table", HashValue: "h"}
+
+	var first []rangeValuePair
+	err := c.QueryPages(context.Background(), []chunk.IndexQuery{query}, func(q chunk.IndexQuery, batch chunk.ReadBatch) bool {
+		first = append(first, collectPairs(batch)...)
+		return true
+	})
+	if err != nil {
+		t.Fatalf("QueryPages: %v", err)
+	}
+	if len(first) != 3 {
+		t.Fatalf("expected the live call to surface all 3 pairs, got %v", first)
+	}
+
+	var cached []rangeValuePair
+	err = c.QueryPages(context.Background(), []chunk.IndexQuery{query}, func(q chunk.IndexQuery, batch chunk.ReadBatch) bool {
+		cached = append(cached, collectPairs(batch)...)
+		return true
+	})
+	if err != nil {
+		t.Fatalf("QueryPages: %v", err)
+	}
+	if len(inner.liveQueries) != 1 {
+		t.Fatalf("expected the second call to be served from cache, but the wrapped client saw %d live queries", len(inner.liveQueries))
+	}
+	if len(cached) != 3 {
+		t.Fatalf("expected the cached entry to hold all 3 pairs accumulated across callback invocations, got %v", cached)
+	}
+}
+
+// TestCachingIndexClient_CacheHitFalseDoesNotAbandonBatch guards against the
+// bug where a cache hit's callback returning false made QueryPages return
+// early, silently dropping every other query batched into the same call
+// (including the ones that needed to go live).
+func TestCachingIndexClient_CacheHitFalseDoesNotAbandonBatch(t *testing.T) {
+	inner := &fakeIndexClient{pairs: []rangeValuePair{{rangeValue: []byte("a"), value: []byte("1")}}}
+	c := newTestCachingIndexClient(t, inner, time.Minute)
+
+	cached := chunk.IndexQuery{TableName: "not-the-current-table", HashValue: "cached"}
+	c.cache.Add(queryCacheKeyFor(cached), queryCacheEntry{
+		expires: time.Now().Add(time.Minute),
+		pairs:   []rangeValuePair{{rangeValue: []byte("a"), value: []byte("1")}},
+	})
+	live := chunk.IndexQuery{TableName: "not-the-current-table", HashValue: "live"}
+
+	var seen []chunk.IndexQuery
+	err := c.QueryPages(context.Background(), []chunk.IndexQuery{cached, live}, func(q chunk.IndexQuery, batch chunk.ReadBatch) bool {
+		seen = append(seen, q)
+		return false
+	})
+	if err != nil {
+		t.Fatalf("QueryPages: %v", err)
+	}
+
+	if len(seen) != 2 {
+		t.Fatalf("expected the callback to be invoked for both the cached and live query, got %v", seen)
+	}
+	if len(inner.liveQueries) != 1 || inner.liveQueries[0].HashValue != "live" {
+		t.Fatalf("expected the live query to still be dispatched to the wrapped client, got %v", inner.liveQueries)
+	}
+}
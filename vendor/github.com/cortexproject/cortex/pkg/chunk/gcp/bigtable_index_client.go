@@ -5,12 +5,19 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"hash/fnv"
+	"os"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"cloud.google.com/go/bigtable"
 	ot "github.com/opentracing/opentracing-go"
 	otlog "github.com/opentracing/opentracing-go/log"
+	"golang.org/x/sync/errgroup"
 	"google.golang.org/api/option"
+	"google.golang.org/grpc"
 
 	"github.com/cortexproject/cortex/pkg/chunk"
 	chunk_util "github.com/cortexproject/cortex/pkg/chunk/util"
@@ -26,6 +33,10 @@ const (
 	separator    = "\000"
 	maxRowReads  = 100
 	null         = string('\xff')
+
+	// defaultMaxReadConcurrency bounds the number of concurrent ReadRows RPCs
+	// QueryPages will issue when MaxReadConcurrency is unset.
+	defaultMaxReadConcurrency = 32
 )
 
 // Config for a StorageClient
@@ -36,6 +47,24 @@ type Config struct {
 	GRPCClientConfig grpcclient.Config `yaml:"grpc_client_config"`
 
 	ColumnKey bool
+
+	// MaxReadConcurrency bounds the number of concurrent Bigtable ReadRows
+	// RPCs that QueryPages will issue for a single batch of queries. Only the
+	// column-key clients use it; storageClientV1.QueryPages does not.
+	MaxReadConcurrency int `yaml:"max_read_concurrency"`
+
+	// QueryCacheSize is the number of QueryPages results to keep in an
+	// in-memory LRU cache. 0 (the default) disables the cache.
+	QueryCacheSize int `yaml:"query_cache_size"`
+
+	// QueryCacheTTL is how long a cached QueryPages result stays valid.
+	QueryCacheTTL time.Duration `yaml:"query_cache_ttl"`
+
+	// EmulatorHost, if set, points at a Bigtable emulator (e.g. `cbt
+	// emulator`) instead of the real service: requests are sent unauthenticated
+	// over an insecure connection. Falls back to the BIGTABLE_EMULATOR_HOST
+	// env var, the same one the Bigtable CLI and client libraries honor.
+	EmulatorHost string `yaml:"emulator_host"`
 }
 
 // RegisterFlags adds the flags required to config this to the given FlagSet
@@ -45,10 +74,83 @@ func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
 
 	cfg.GRPCClientConfig.RegisterFlags("bigtable", f)
 
+	f.IntVar(&cfg.MaxReadConcurrency, "bigtable.max-read-concurrency", defaultMaxReadConcurrency, "Maximum number of concurrent ReadRows RPCs issued per QueryPages call by the column-key index clients.")
+	f.IntVar(&cfg.QueryCacheSize, "bigtable.query-cache-size", 0, "Number of QueryPages results to cache in memory. 0 to disable.")
+	f.DurationVar(&cfg.QueryCacheTTL, "bigtable.query-cache-ttl", defaultQueryCacheTTL, "How long a cached QueryPages result stays valid.")
+	f.StringVar(&cfg.EmulatorHost, "bigtable.emulator-host", "", "If set, talk to a Bigtable emulator at this host:port instead of the real Bigtable service. Falls back to the BIGTABLE_EMULATOR_HOST env var.")
+
 	// Deprecated.
 	f.Int("bigtable.max-recv-msg-size", 100<<20, "DEPRECATED. Bigtable grpc max receive message size.")
 }
 
+// newBigtableClient builds the *bigtable.Client shared by all the StorageClient
+// constructors in this package. If cfg.EmulatorHost (or BIGTABLE_EMULATOR_HOST)
+// is set, it connects to that emulator instead of the real Bigtable service,
+// unauthenticated and over an insecure connection; extraOpts are ignored in
+// that case, since they typically carry credentials-dependent dial options.
+func newBigtableClient(ctx context.Context, cfg Config, extraOpts ...option.ClientOption) (*bigtable.Client, error) {
+	host := cfg.EmulatorHost
+	if host == "" {
+		host = os.Getenv("BIGTABLE_EMULATOR_HOST")
+	}
+
+	if host != "" {
+		return bigtable.NewClient(ctx, cfg.Project, cfg.Instance,
+			option.WithEndpoint(host),
+			option.WithoutAuthentication(),
+			option.WithGRPCDialOption(grpc.WithInsecure()),
+		)
+	}
+
+	opts := append(instrumentation(), extraOpts...)
+	return bigtable.NewClient(ctx, cfg.Project, cfg.Instance, opts...)
+}
+
+// schemaVersionHashedColumnKey is the schema_config "schema" version that
+// switches row keys to the fnv-hashed, shard-prefixed form written by
+// storageClientHashedColumnKey.
+const schemaVersionHashedColumnKey = "v12"
+
+// schemaVersionFor looks up which schema_config period wrote tableName and
+// returns its Schema version string (e.g. "v11"), or "" if no configured
+// period produced it. This is how storageClientHashedColumnKey decides
+// whether a given table predates the hashed-row-key cutover, the same way
+// the v9 vs. v10/v11 schema versions already pick between NewStorageClientV1
+// and NewStorageClientColumnKey.
+func schemaVersionFor(schemaCfg chunk.SchemaConfig, tableName string) string {
+	for _, period := range schemaCfg.Configs {
+		if schemaCfg.TableFor(period.From) == tableName {
+			return period.Schema
+		}
+	}
+	return ""
+}
+
+// schemaVersionAtLeast reports whether version is ">= cutover" in schema
+// version terms (e.g. "v9" < "v10" < "v11"). Versions are compared
+// numerically, not lexically, since "v9" > "v10" as plain strings. An
+// unrecognised or empty version (no schema_config period matched the table)
+// is treated as older than any cutover.
+func schemaVersionAtLeast(version, cutover string) bool {
+	v, ok := parseSchemaVersion(version)
+	if !ok {
+		return false
+	}
+	c, ok := parseSchemaVersion(cutover)
+	if !ok {
+		return false
+	}
+	return v >= c
+}
+
+func parseSchemaVersion(version string) (int, bool) {
+	n, err := strconv.Atoi(strings.TrimPrefix(version, "v"))
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
 // storageClientColumnKey implements chunk.storageClient for GCP.
 type storageClientColumnKey struct {
 	cfg       Config
@@ -64,14 +166,11 @@ type storageClientV1 struct {
 
 // NewStorageClientV1 returns a new v1 StorageClient.
 func NewStorageClientV1(ctx context.Context, cfg Config, schemaCfg chunk.SchemaConfig) (chunk.IndexClient, error) {
-	opts := instrumentation()
-	opts = append(opts, option.WithGRPCDialOption(cfg.GRPCClientConfig.DialOption()))
-
-	client, err := bigtable.NewClient(ctx, cfg.Project, cfg.Instance, opts...)
+	client, err := newBigtableClient(ctx, cfg, option.WithGRPCDialOption(cfg.GRPCClientConfig.DialOption()))
 	if err != nil {
 		return nil, err
 	}
-	return newStorageClientV1(cfg, schemaCfg, client), nil
+	return wrapQueryCache(cfg, schemaCfg, newStorageClientV1(cfg, schemaCfg, client))
 }
 
 func newStorageClientV1(cfg Config, schemaCfg chunk.SchemaConfig, client *bigtable.Client) *storageClientV1 {
@@ -90,11 +189,11 @@ func newStorageClientV1(cfg Config, schemaCfg chunk.SchemaConfig, client *bigtab
 
 // NewStorageClientColumnKey returns a new v2 StorageClient.
 func NewStorageClientColumnKey(ctx context.Context, cfg Config, schemaCfg chunk.SchemaConfig) (chunk.IndexClient, error) {
-	client, err := bigtable.NewClient(ctx, cfg.Project, cfg.Instance, instrumentation()...)
+	client, err := newBigtableClient(ctx, cfg)
 	if err != nil {
 		return nil, err
 	}
-	return newStorageClientColumnKey(cfg, schemaCfg, client), nil
+	return wrapQueryCache(cfg, schemaCfg, newStorageClientColumnKey(cfg, schemaCfg, client))
 }
 
 func newStorageClientColumnKey(cfg Config, schemaCfg chunk.SchemaConfig, client *bigtable.Client) *storageClientColumnKey {
@@ -150,6 +249,10 @@ func (s *storageClientColumnKey) BatchWrite(ctx context.Context, batch chunk.Wri
 	bigtableBatch := batch.(bigtableWriteBatch)
 
 	for tableName, rows := range bigtableBatch.tables {
+		if len(rows) == 0 {
+			continue
+		}
+
 		table := s.client.Open(tableName)
 		rowKeys := make([]string, 0, len(rows))
 		muts := make([]*bigtable.Mutation, 0, len(rows))
@@ -173,6 +276,25 @@ func (s *storageClientColumnKey) BatchWrite(ctx context.Context, batch chunk.Wri
 }
 
 func (s *storageClientColumnKey) QueryPages(ctx context.Context, queries []chunk.IndexQuery, callback func(chunk.IndexQuery, chunk.ReadBatch) bool) error {
+	return s.queryPages(ctx, queries, s.rowKey, callback)
+}
+
+// rowKey returns the Bigtable row key that a query's primary row lives at.
+// Overridden by storageClientHashedColumnKey to prepend a shard prefix.
+func (s *storageClientColumnKey) rowKey(query chunk.IndexQuery) string {
+	return query.HashValue
+}
+
+// effectiveMaxReadConcurrency returns cfg.MaxReadConcurrency, or
+// defaultMaxReadConcurrency if it's unset.
+func effectiveMaxReadConcurrency(cfg Config) int {
+	if cfg.MaxReadConcurrency <= 0 {
+		return defaultMaxReadConcurrency
+	}
+	return cfg.MaxReadConcurrency
+}
+
+func (s *storageClientColumnKey) queryPages(ctx context.Context, queries []chunk.IndexQuery, rowKey func(chunk.IndexQuery) string, callback func(chunk.IndexQuery, chunk.ReadBatch) bool) error {
 	sp, ctx := ot.StartSpanFromContext(ctx, "QueryPages")
 	defer sp.Finish()
 
@@ -196,18 +318,29 @@ func (s *storageClientColumnKey) QueryPages(ctx context.Context, queries []chunk
 				queries: map[string]chunk.IndexQuery{},
 			}
 		}
-		tq.queries[query.HashValue] = query
-		tq.rows = append(tq.rows, query.HashValue)
+		row := rowKey(query)
+		tq.queries[row] = query
+		tq.rows = append(tq.rows, row)
 		tableQueries[query.TableName] = tq
 	}
 
-	errs := make(chan error)
+	sem := make(chan struct{}, effectiveMaxReadConcurrency(s.cfg))
+
+	g, ctx := errgroup.WithContext(ctx)
 	for _, tq := range tableQueries {
 		table := s.client.Open(tq.name)
 
 		for i := 0; i < len(tq.rows); i += maxRowReads {
 			page := tq.rows[i:util.Min(i+maxRowReads, len(tq.rows))]
-			go func(page bigtable.RowList, tq tableQuery) {
+			tq := tq
+			g.Go(func() error {
+				select {
+				case sem <- struct{}{}:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+				defer func() { <-sem }()
+
 				var processingErr error
 				// rows are returned in key order, not order in row list
 				err := table.ReadRows(ctx, page, func(row bigtable.Row) bool {
@@ -229,24 +362,14 @@ func (s *storageClientColumnKey) QueryPages(ctx context.Context, queries []chunk
 				})
 
 				if processingErr != nil {
-					errs <- processingErr
-				} else {
-					errs <- err
+					return processingErr
 				}
-			}(page, tq)
+				return err
+			})
 		}
 	}
 
-	var lastErr error
-	for _, tq := range tableQueries {
-		for i := 0; i < len(tq.rows); i += maxRowReads {
-			err := <-errs
-			if err != nil {
-				lastErr = err
-			}
-		}
-	}
-	return lastErr
+	return g.Wait()
 }
 
 func (s *storageClientColumnKey) query(ctx context.Context, query chunk.IndexQuery, callback func(result chunk.ReadBatch) (shouldContinue bool)) error {
@@ -265,7 +388,7 @@ func (s *storageClientColumnKey) query(ctx context.Context, query chunk.IndexQue
 		rOpts = append(rOpts, bigtable.RowFilter(bigtable.ColumnRangeFilter(columnFamily, string(query.RangeValueStart), null)))
 	}
 
-	r, err := table.ReadRow(ctx, query.HashValue, rOpts...)
+	r, err := table.ReadRow(ctx, s.rowKey(query), rOpts...)
 	if err != nil {
 		sp.LogFields(otlog.String("error", err.Error()))
 		return errors.WithStack(err)
@@ -293,6 +416,65 @@ func (s *storageClientColumnKey) query(ctx context.Context, query chunk.IndexQue
 	return nil
 }
 
+const hashedRowKeyShards = 256
+
+// hashedRowKeyPrefix returns the shard prefix storageClientHashedColumnKey
+// prepends to hashValue to spread distinct hashValues across
+// hashedRowKeyShards key ranges. The prefix depends only on hashValue, so
+// every row for a given hashValue gets the same prefix.
+func hashedRowKeyPrefix(hashValue string) string {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(hashValue))
+	return fmt.Sprintf("%02x#", h.Sum64()%hashedRowKeyShards)
+}
+
+// storageClientHashedColumnKey is a storageClientColumnKey that prepends a
+// deterministic shard prefix to row keys for better write distribution
+// across Bigtable tablets, at the cost of three extra bytes per row key.
+// Tables from schema_config periods older than schemaVersionHashedColumnKey
+// were written by storageClientColumnKey and must still be read with
+// un-prefixed row keys; see rowKey.
+type storageClientHashedColumnKey struct {
+	storageClientColumnKey
+}
+
+// NewStorageClientHashedColumnKey returns a new v3 StorageClient that hashes row keys for write distribution.
+func NewStorageClientHashedColumnKey(ctx context.Context, cfg Config, schemaCfg chunk.SchemaConfig) (chunk.IndexClient, error) {
+	client, err := newBigtableClient(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return wrapQueryCache(cfg, schemaCfg, newStorageClientHashedColumnKey(cfg, schemaCfg, client))
+}
+
+func newStorageClientHashedColumnKey(cfg Config, schemaCfg chunk.SchemaConfig, client *bigtable.Client) *storageClientHashedColumnKey {
+	s := &storageClientHashedColumnKey{
+		storageClientColumnKey{
+			cfg:       cfg,
+			schemaCfg: schemaCfg,
+			client:    client,
+		},
+	}
+	s.keysFn = func(hashValue string, rangeValue []byte) (string, string) {
+		return hashedRowKeyPrefix(hashValue) + hashValue, string(rangeValue)
+	}
+	return s
+}
+
+// rowKey overrides storageClientColumnKey.rowKey to read from the hashed
+// shard the row was written to, unless the table predates the schema
+// version that introduced hashed row keys.
+func (s *storageClientHashedColumnKey) rowKey(query chunk.IndexQuery) string {
+	if !schemaVersionAtLeast(schemaVersionFor(s.schemaCfg, query.TableName), schemaVersionHashedColumnKey) {
+		return query.HashValue
+	}
+	return hashedRowKeyPrefix(query.HashValue) + query.HashValue
+}
+
+func (s *storageClientHashedColumnKey) QueryPages(ctx context.Context, queries []chunk.IndexQuery, callback func(chunk.IndexQuery, chunk.ReadBatch) bool) error {
+	return s.queryPages(ctx, queries, s.rowKey, callback)
+}
+
 // columnKeyBatch represents a batch of values read from Bigtable.
 type columnKeyBatch struct {
 	items []bigtable.ReadItem
@@ -327,6 +509,15 @@ func (s *storageClientV1) QueryPages(ctx context.Context, queries []chunk.IndexQ
 	return chunk_util.DoParallelQueries(ctx, s.query, queries, callback)
 }
 
+// valueFilterable reports whether value can be pushed down server-side via
+// Bigtable's ValueFilter, which takes a RE2 pattern matched against the
+// whole cell value. QuoteMeta escapes any regex metacharacters, but a NUL
+// byte still isn't valid RE2 input, so values containing one must fall back
+// to a client-side comparison instead.
+func valueFilterable(value []byte) bool {
+	return !bytes.ContainsRune(value, 0)
+}
+
 func (s *storageClientV1) query(ctx context.Context, query chunk.IndexQuery, callback func(result chunk.ReadBatch) (shouldContinue bool)) error {
 	const null = string('\xff')
 
@@ -337,15 +528,16 @@ func (s *storageClientV1) query(ctx context.Context, query chunk.IndexQuery, cal
 
 	var rowRange bigtable.RowRange
 
-	/* Bigtable only seems to support regex match on cell values, so doing it
-	   client side for now
-	readOpts := []bigtable.ReadOption{
-		bigtable.RowFilter(bigtable.FamilyFilter(columnFamily)),
-	}
-	if query.ValueEqual != nil {
-		readOpts = append(readOpts, bigtable.RowFilter(bigtable.ValueFilter(string(query.ValueEqual))))
+	// See valueFilterable: values that aren't valid RE2 input fall back to
+	// the client-side comparison below.
+	var rOpts []bigtable.ReadOption
+	serverSideFilter := query.ValueEqual != nil && valueFilterable(query.ValueEqual)
+	if serverSideFilter {
+		rOpts = append(rOpts, bigtable.RowFilter(bigtable.ChainFilters(
+			bigtable.FamilyFilter(columnFamily),
+			bigtable.ValueFilter(regexp.QuoteMeta(string(query.ValueEqual))),
+		)))
 	}
-	*/
 
 	if len(query.RangeValuePrefix) > 0 {
 		rowRange = bigtable.PrefixRange(query.HashValue + separator + string(query.RangeValuePrefix))
@@ -356,14 +548,14 @@ func (s *storageClientV1) query(ctx context.Context, query chunk.IndexQuery, cal
 	}
 
 	err := table.ReadRows(ctx, rowRange, func(r bigtable.Row) bool {
-		if query.ValueEqual == nil || bytes.Equal(r[columnFamily][0].Value, query.ValueEqual) {
-			return callback(&rowBatch{
-				row: r,
-			})
+		if !serverSideFilter && query.ValueEqual != nil && !bytes.Equal(r[columnFamily][0].Value, query.ValueEqual) {
+			return true
 		}
 
-		return true
-	})
+		return callback(&rowBatch{
+			row: r,
+		})
+	}, rOpts...)
 	if err != nil {
 		sp.LogFields(otlog.String("error", err.Error()))
 		return errors.WithStack(err)
@@ -0,0 +1,29 @@
+package gcp
+
+import "testing"
+
+func TestEffectiveMaxReadConcurrency(t *testing.T) {
+	for name, tc := range map[string]struct {
+		cfg  Config
+		want int
+	}{
+		"unset falls back to the default": {
+			cfg:  Config{},
+			want: defaultMaxReadConcurrency,
+		},
+		"negative falls back to the default": {
+			cfg:  Config{MaxReadConcurrency: -1},
+			want: defaultMaxReadConcurrency,
+		},
+		"positive value is used as-is": {
+			cfg:  Config{MaxReadConcurrency: 4},
+			want: 4,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if got := effectiveMaxReadConcurrency(tc.cfg); got != tc.want {
+				t.Errorf("effectiveMaxReadConcurrency() = %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
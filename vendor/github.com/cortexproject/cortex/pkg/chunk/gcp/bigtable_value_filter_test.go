@@ -0,0 +1,29 @@
+package gcp
+
+import "testing"
+
+func TestValueFilterable(t *testing.T) {
+	for name, tc := range map[string]struct {
+		value []byte
+		want  bool
+	}{
+		"plain ASCII value is filterable": {
+			value: []byte("some-value"),
+			want:  true,
+		},
+		"regex metacharacters are still filterable (QuoteMeta escapes them)": {
+			value: []byte("a.b*c"),
+			want:  true,
+		},
+		"value containing a NUL byte is not filterable": {
+			value: []byte("a\x00b"),
+			want:  false,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if got := valueFilterable(tc.value); got != tc.want {
+				t.Errorf("valueFilterable(%q) = %v, want %v", tc.value, got, tc.want)
+			}
+		})
+	}
+}